@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// UserPolicy is the per-user policy resolved from an "acl=" file: which
+// destination hosts a user may reach, and how much traffic they're allowed
+// to push through the proxy.
+type UserPolicy struct {
+	AllowHosts []string
+	DenyHosts  []string
+	RPS        float64
+	Burst      int
+	MaxConns   int
+	Expires    time.Time
+
+	limiter   *rate.Limiter
+	connSlots chan struct{}
+}
+
+// Expired reports whether the policy's validity window has passed.
+func (p *UserPolicy) Expired() bool {
+	return !p.Expires.IsZero() && time.Now().After(p.Expires)
+}
+
+// HostAllowed applies deny_hosts then allow_hosts (glob or CIDR patterns)
+// against the proxy's destination host. An empty allow_hosts list means
+// "allow anything not denied".
+func (p *UserPolicy) HostAllowed(host string) bool {
+	for _, pattern := range p.DenyHosts {
+		if matchHostPattern(pattern, host) {
+			return false
+		}
+	}
+	if len(p.AllowHosts) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowHosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow consults the per-user rate.Limiter, if one is configured.
+func (p *UserPolicy) Allow() bool {
+	if p.limiter == nil {
+		return true
+	}
+	return p.limiter.Allow()
+}
+
+// Limited reports whether this policy actually enforces max_conns, i.e.
+// whether TryAcquireConn/ReleaseConn do anything beyond a no-op. Callers can
+// use this to skip setting up connection-lifetime bookkeeping entirely for
+// policies that only carry allow_hosts/deny_hosts/rps.
+func (p *UserPolicy) Limited() bool {
+	return p.connSlots != nil
+}
+
+// TryAcquireConn reserves a connection slot against max_conns. Callers must
+// call ReleaseConn once the connection ends.
+func (p *UserPolicy) TryAcquireConn() bool {
+	if p.connSlots == nil {
+		return true
+	}
+	select {
+	case p.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *UserPolicy) ReleaseConn() {
+	if p.connSlots == nil {
+		return
+	}
+	select {
+	case <-p.connSlots:
+	default:
+	}
+}
+
+func matchHostPattern(pattern, host string) bool {
+	bareHost := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		bareHost = h
+	}
+	bareHost = strings.ToLower(bareHost)
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		if ip := net.ParseIP(bareHost); ip != nil {
+			return network.Contains(ip)
+		}
+		return false
+	}
+	ok, err := path.Match(strings.ToLower(pattern), bareHost)
+	return err == nil && ok
+}
+
+type aclFileEntry struct {
+	AllowHosts []string `yaml:"allow_hosts" json:"allow_hosts"`
+	DenyHosts  []string `yaml:"deny_hosts" json:"deny_hosts"`
+	RPS        float64  `yaml:"rps" json:"rps"`
+	Burst      int      `yaml:"burst" json:"burst"`
+	MaxConns   int      `yaml:"max_conns" json:"max_conns"`
+	Expires    string   `yaml:"expires" json:"expires"`
+}
+
+// loadACLFile parses a YAML or JSON file (picked by extension, YAML by
+// default) keyed by username into resolved UserPolicy objects.
+func loadACLFile(filename string) (map[string]*UserPolicy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]aclFileEntry)
+	if strings.HasSuffix(strings.ToLower(filename), ".json") {
+		err = json.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse acl file %q: %w", filename, err)
+	}
+
+	policies := make(map[string]*UserPolicy, len(raw))
+	for user, entry := range raw {
+		policy := &UserPolicy{
+			AllowHosts: entry.AllowHosts,
+			DenyHosts:  entry.DenyHosts,
+			RPS:        entry.RPS,
+			Burst:      entry.Burst,
+			MaxConns:   entry.MaxConns,
+		}
+		if entry.Expires != "" {
+			expires, err := time.Parse(time.RFC3339, entry.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("acl entry %q: bad \"expires\": %w", user, err)
+			}
+			policy.Expires = expires
+		}
+		if policy.RPS > 0 {
+			burst := policy.Burst
+			if burst <= 0 {
+				burst = 1
+			}
+			policy.limiter = rate.NewLimiter(rate.Limit(policy.RPS), burst)
+		}
+		if policy.MaxConns > 0 {
+			policy.connSlots = make(chan struct{}, policy.MaxConns)
+		}
+		policies[user] = policy
+	}
+	return policies, nil
+}
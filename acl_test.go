@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestMatchHostPatternCaseInsensitive(t *testing.T) {
+	cases := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"Example.COM", "example.com", true},
+		{"*.Example.com", "Sub.EXAMPLE.com", true},
+		{"example.com", "other.com", false},
+	}
+	for _, c := range cases {
+		if got := matchHostPattern(c.pattern, c.host); got != c.want {
+			t.Errorf("matchHostPattern(%q, %q) = %v, want %v", c.pattern, c.host, got, c.want)
+		}
+	}
+}
+
+func TestUserPolicyHostAllowed(t *testing.T) {
+	p := &UserPolicy{
+		AllowHosts: []string{"*.example.com"},
+		DenyHosts:  []string{"blocked.example.com"},
+	}
+	if !p.HostAllowed("api.example.com:443") {
+		t.Error("expected api.example.com to be allowed")
+	}
+	if p.HostAllowed("blocked.example.com") {
+		t.Error("expected blocked.example.com to be denied")
+	}
+	if p.HostAllowed("other.com") {
+		t.Error("expected host outside allow_hosts to be denied")
+	}
+}
+
+func TestUserPolicyHostAllowedEmptyAllowList(t *testing.T) {
+	p := &UserPolicy{DenyHosts: []string{"blocked.com"}}
+	if !p.HostAllowed("anything.com") {
+		t.Error("expected empty allow_hosts to permit anything not denied")
+	}
+	if p.HostAllowed("blocked.com") {
+		t.Error("expected blocked.com to be denied")
+	}
+}
+
+func TestUserPolicyTryAcquireConn(t *testing.T) {
+	p := &UserPolicy{MaxConns: 1}
+	p.connSlots = make(chan struct{}, p.MaxConns)
+
+	if !p.TryAcquireConn() {
+		t.Fatal("first TryAcquireConn should succeed")
+	}
+	if p.TryAcquireConn() {
+		t.Fatal("second TryAcquireConn should fail once max_conns is exhausted")
+	}
+	p.ReleaseConn()
+	if !p.TryAcquireConn() {
+		t.Fatal("TryAcquireConn should succeed again after ReleaseConn")
+	}
+}
+
+func TestUserPolicyLimited(t *testing.T) {
+	unlimited := &UserPolicy{}
+	if unlimited.Limited() {
+		t.Error("policy with no max_conns should not be Limited")
+	}
+
+	limited := &UserPolicy{MaxConns: 1}
+	limited.connSlots = make(chan struct{}, limited.MaxConns)
+	if !limited.Limited() {
+		t.Error("policy with max_conns should be Limited")
+	}
+}
+
+func TestUserPolicyExpired(t *testing.T) {
+	p := &UserPolicy{}
+	if p.Expired() {
+		t.Error("zero Expires should never be expired")
+	}
+}
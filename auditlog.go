@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type AuthResult string
+
+const (
+	AuthResultSuccess       AuthResult = "success"
+	AuthResultFailure       AuthResult = "failure"
+	AuthResultHiddenTrigger AuthResult = "hidden_domain_trigger"
+	AuthResultCertRejected  AuthResult = "cert_rejected"
+)
+
+// AuditEvent is a single structured record of an authentication decision,
+// independent of the free-form proxy request log kept by CondLogger.
+type AuditEvent struct {
+	Time     time.Time  `json:"time"`
+	RemoteIP string     `json:"remote_ip"`
+	Username string     `json:"username"`
+	Method   string     `json:"method"`
+	Host     string     `json:"host"`
+	Result   AuthResult `json:"result"`
+	Reason   string     `json:"reason,omitempty"`
+}
+
+func newAuditEvent(req *http.Request, username string, result AuthResult, reason string) AuditEvent {
+	return AuditEvent{
+		Time:     time.Now(),
+		RemoteIP: forwardClientIP(req),
+		Username: username,
+		Method:   req.Method,
+		Host:     req.Host,
+		Result:   result,
+		Reason:   reason,
+	}
+}
+
+// AuditSink receives authentication audit events. Implementations must be
+// safe for concurrent use.
+type AuditSink interface {
+	Emit(event AuditEvent)
+}
+
+// NopAuditSink discards every event; it's the default when no -auth-log*
+// flag enables a sink.
+type NopAuditSink struct{}
+
+func (NopAuditSink) Emit(AuditEvent) {}
+
+// multiAuditSink fans an event out to every configured sink.
+type multiAuditSink struct {
+	sinks []AuditSink
+}
+
+func (m *multiAuditSink) Emit(event AuditEvent) {
+	for _, sink := range m.sinks {
+		sink.Emit(event)
+	}
+}
+
+// jsonLinesAuditSink writes one JSON object per line to an io.Writer.
+type jsonLinesAuditSink struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+func newJSONLinesAuditSink(w io.Writer) *jsonLinesAuditSink {
+	return &jsonLinesAuditSink{w: w}
+}
+
+func (s *jsonLinesAuditSink) Emit(event AuditEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.w.Write(data)
+}
+
+// syslogAuditSink writes a one-line summary of each event to syslog.
+type syslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogAuditSink() (*syslogAuditSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "dumbproxy")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogAuditSink{writer: w}, nil
+}
+
+func (s *syslogAuditSink) Emit(event AuditEvent) {
+	line := fmt.Sprintf("result=%s user=%q remote_ip=%s method=%s host=%q reason=%q",
+		event.Result, event.Username, event.RemoteIP, event.Method, event.Host, event.Reason)
+	if event.Result == AuthResultSuccess {
+		s.writer.Info(line)
+	} else {
+		s.writer.Notice(line)
+	}
+}
+
+// AuditLogConfig bundles the -auth-log* flags.
+type AuditLogConfig struct {
+	Path       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+	Format     string
+	Syslog     bool
+	Stdout     bool
+}
+
+// RegisterAuditLogFlags wires the -auth-log* flags onto fs and returns the
+// config they populate once fs.Parse has run.
+func RegisterAuditLogFlags(fs *flag.FlagSet) *AuditLogConfig {
+	cfg := &AuditLogConfig{}
+	fs.StringVar(&cfg.Path, "auth-log", "", "path to write structured auth audit events to (JSON lines); empty disables file output")
+	fs.IntVar(&cfg.MaxSizeMB, "auth-log-max-size", 100, "max size in MB of the auth log file before it gets rotated")
+	fs.IntVar(&cfg.MaxBackups, "auth-log-max-backups", 5, "max number of rotated auth log backups to keep")
+	fs.IntVar(&cfg.MaxAgeDays, "auth-log-max-age", 0, "max age in days to retain rotated auth log backups; 0 keeps them indefinitely (subject to -auth-log-max-backups)")
+	fs.StringVar(&cfg.Format, "auth-log-format", "json", "auth log record format (currently only \"json\" is supported)")
+	fs.BoolVar(&cfg.Syslog, "auth-log-syslog", false, "also send auth audit events to syslog")
+	fs.BoolVar(&cfg.Stdout, "auth-log-stdout", false, "also print auth audit events to stdout")
+	return cfg
+}
+
+// NewAuditSink builds the configured AuditSink fan-out, returning
+// NopAuditSink when no sink is enabled.
+func NewAuditSink(cfg *AuditLogConfig) (AuditSink, error) {
+	var sinks []AuditSink
+
+	if cfg.Path != "" {
+		if cfg.Format != "json" {
+			return nil, fmt.Errorf("unsupported -auth-log-format %q", cfg.Format)
+		}
+		sinks = append(sinks, newJSONLinesAuditSink(&lumberjack.Logger{
+			Filename:   cfg.Path,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+		}))
+	}
+
+	if cfg.Syslog {
+		sink, err := newSyslogAuditSink()
+		if err != nil {
+			return nil, fmt.Errorf("can't open syslog for auth audit log: %w", err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if cfg.Stdout {
+		sinks = append(sinks, newJSONLinesAuditSink(os.Stdout))
+	}
+
+	if len(sinks) == 0 {
+		return NopAuditSink{}, nil
+	}
+	return &multiAuditSink{sinks: sinks}, nil
+}
@@ -42,6 +42,7 @@ Commercial support is available at
 </html>`
 const BAD_REQ_MSG = "Bad Request\n"
 const AUTH_TRIGGERED_MSG = "Browser auth triggered!\n"
+const TOO_MANY_REQ_MSG = "Too Many Requests\n"
 const EPOCH_EXPIRE = "Thu, 01 Jan 1970 00:00:01 GMT"
 
 type Auth interface {
@@ -49,27 +50,34 @@ type Auth interface {
 	Stop()
 }
 
-func NewAuth(paramstr string, logger *CondLogger) (Auth, error) {
+func NewAuth(paramstr string, logger *CondLogger, audit AuditSink) (Auth, error) {
 	url, err := url.Parse(paramstr)
 	if err != nil {
 		return nil, err
 	}
+	if audit == nil {
+		audit = NopAuditSink{}
+	}
 
 	switch strings.ToLower(url.Scheme) {
 	case "static":
-		return NewStaticAuth(url, logger)
+		return NewStaticAuth(url, logger, audit)
 	case "basicfile":
-		return NewBasicFileAuth(url, logger)
+		return NewBasicFileAuth(url, logger, audit)
+	case "cookie":
+		return NewCookieAuth(url, logger, audit)
+	case "forward":
+		return NewForwardAuth(url, logger, audit)
 	case "cert":
-		return CertAuth{}, nil
+		return CertAuth{audit: audit}, nil
 	case "none":
-		return NoAuth{}, nil
+		return NoAuth{audit: audit}, nil
 	default:
 		return nil, errors.New("Unknown auth scheme")
 	}
 }
 
-func NewStaticAuth(param_url *url.URL, logger *CondLogger) (*BasicAuth, error) {
+func NewStaticAuth(param_url *url.URL, logger *CondLogger, audit AuditSink) (*BasicAuth, error) {
 	values, err := url.ParseQuery(param_url.RawQuery)
 	if err != nil {
 		return nil, err
@@ -97,12 +105,18 @@ func NewStaticAuth(param_url *url.URL, logger *CondLogger) (*BasicAuth, error) {
 		return nil, fmt.Errorf("can't instantiate pwFile: %w", err)
 	}
 
-	return &BasicAuth{
+	auth := &BasicAuth{
 		hiddenDomain: strings.ToLower(values.Get("hidden_domain")),
 		logger:       logger,
 		pwFile:       pwFile,
-		stopChan:     make(chan struct{}),
-	}, nil
+		audit:        audit,
+	}
+
+	if err := auth.configureTOTP(values, username); err != nil {
+		return nil, err
+	}
+
+	return auth, nil
 }
 
 func requireBasicAuth(wr http.ResponseWriter, req *http.Request, hidden_domain string) {
@@ -120,16 +134,64 @@ func requireBasicAuth(wr http.ResponseWriter, req *http.Request, hidden_domain s
 
 type BasicAuth struct {
 	pwFilename   string
-	pwFile       *htpasswd.File
+	pwFormat     string
+	pwFile       PasswordMatcher
 	pwMux        sync.RWMutex
+	aclFilename  string
+	acl          map[string]*UserPolicy
+	aclMux       sync.RWMutex
+	totpEnabled  bool
+	totpSidecar  string
+	totpSecrets  map[string]string
+	totpMux      sync.RWMutex
+	totpGrace    time.Duration
+	totpCache    *totpGraceCache
 	logger       *CondLogger
+	audit        AuditSink
 	hiddenDomain string
-	stopOnce     sync.Once
-	stopChan     chan struct{}
-	lastReloaded time.Time
+	reloader     *reloader
+}
+
+// configureTOTP parses the totp=/totp_path=/totp_secret=/totp_grace=
+// parameters shared by static and basicfile auth. staticUser is non-empty
+// only for NewStaticAuth, where the secret (if any) is resolved immediately
+// instead of through reload().
+func (auth *BasicAuth) configureTOTP(values url.Values, staticUser string) error {
+	auth.totpEnabled = values.Get("totp") == "true"
+	if !auth.totpEnabled {
+		return nil
+	}
+	auth.totpSidecar = values.Get("totp_path")
+
+	totpGrace, err := time.ParseDuration(values.Get("totp_grace"))
+	if err != nil || totpGrace <= 0 {
+		totpGrace = DEFAULT_TOTP_GRACE
+	}
+	auth.totpGrace = totpGrace
+	auth.totpCache = newTOTPGraceCache(4096)
+
+	if staticUser == "" {
+		return nil
+	}
+
+	if auth.totpSidecar != "" {
+		secrets, err := loadTOTPSidecar(auth.totpSidecar)
+		if err != nil {
+			return fmt.Errorf("can't load totp_path file: %w", err)
+		}
+		auth.totpSecrets = secrets
+		return nil
+	}
+
+	secret := values.Get("totp_secret")
+	if secret == "" {
+		return errors.New("\"totp_secret\" or \"totp_path\" parameter is required when totp=true")
+	}
+	auth.totpSecrets = map[string]string{staticUser: secret}
+	return nil
 }
 
-func NewBasicFileAuth(param_url *url.URL, logger *CondLogger) (*BasicAuth, error) {
+func NewBasicFileAuth(param_url *url.URL, logger *CondLogger, audit AuditSink) (*BasicAuth, error) {
 	values, err := url.ParseQuery(param_url.RawQuery)
 	if err != nil {
 		return nil, err
@@ -139,14 +201,31 @@ func NewBasicFileAuth(param_url *url.URL, logger *CondLogger) (*BasicAuth, error
 		return nil, errors.New("\"path\" parameter is missing from auth config URI")
 	}
 
+	format := values.Get("format")
+	if format == "" {
+		format = "htpasswd"
+	}
+	switch format {
+	case "htpasswd", "argon2id", "scrypt":
+	default:
+		return nil, fmt.Errorf("unsupported \"format\" parameter: %q", format)
+	}
+
 	auth := &BasicAuth{
 		hiddenDomain: strings.ToLower(values.Get("hidden_domain")),
 		pwFilename:   filename,
+		pwFormat:     format,
+		aclFilename:  values.Get("acl"),
 		logger:       logger,
-		stopChan:     make(chan struct{}),
+		audit:        audit,
 	}
 
-	if err := auth.reload(); err != nil {
+	if err := auth.configureTOTP(values, ""); err != nil {
+		return nil, err
+	}
+
+	auth.reloader = newReloader(logger, auth.reloadPasswordData, auth.watchedFiles)
+	if err := auth.reloader.reload(); err != nil {
 		return nil, fmt.Errorf("unable to load initial password list: %w", err)
 	}
 
@@ -158,69 +237,102 @@ func NewBasicFileAuth(param_url *url.URL, logger *CondLogger) (*BasicAuth, error
 	if reloadInterval == 0 {
 		reloadInterval = 15 * time.Second
 	}
-	if reloadInterval > 0 {
-		go auth.reloadLoop(reloadInterval)
-	}
+	auth.reloader.startLoop(reloadInterval)
 
 	return auth, nil
 }
 
-func (auth *BasicAuth) reload() error {
+// watchedFiles lists the files condReload should check mtimes on.
+func (auth *BasicAuth) watchedFiles() []string {
+	watched := []string{auth.pwFilename}
+	if auth.aclFilename != "" {
+		watched = append(watched, auth.aclFilename)
+	}
+	if auth.totpEnabled && auth.totpSidecar != "" {
+		watched = append(watched, auth.totpSidecar)
+	}
+	return watched
+}
+
+func (auth *BasicAuth) reloadPasswordData() error {
 	auth.logger.Info("reloading password file from %q...", auth.pwFilename)
-	newPwFile, err := htpasswd.New(auth.pwFilename, htpasswd.DefaultSystems, func(parseErr error) {
+
+	onParseError := func(parseErr error) {
 		auth.logger.Error("failed to parse line in %q: %v", auth.pwFilename, parseErr)
-	})
+	}
+
+	var newPwFile PasswordMatcher
+	var newTOTPSecrets map[string]string
+	var err error
+
+	if auth.totpEnabled && auth.totpSidecar == "" {
+		var stripped []byte
+		stripped, newTOTPSecrets, err = loadInlineTOTPSecrets(auth.pwFilename)
+		if err != nil {
+			return err
+		}
+		if auth.pwFormat == "htpasswd" {
+			newPwFile, err = htpasswd.NewFromReader(bytes.NewReader(stripped), htpasswd.DefaultSystems, onParseError)
+		} else {
+			newPwFile, err = loadHashPasswordFileFromReader(bytes.NewReader(stripped), auth.pwFormat, onParseError)
+		}
+	} else if auth.pwFormat == "htpasswd" {
+		newPwFile, err = htpasswd.New(auth.pwFilename, htpasswd.DefaultSystems, onParseError)
+	} else {
+		newPwFile, err = loadHashPasswordFile(auth.pwFilename, auth.pwFormat, onParseError)
+	}
 	if err != nil {
 		return err
 	}
 
-	now := time.Now()
+	if auth.totpEnabled && auth.totpSidecar != "" {
+		auth.logger.Info("reloading totp secrets from %q...", auth.totpSidecar)
+		newTOTPSecrets, err = loadTOTPSidecar(auth.totpSidecar)
+		if err != nil {
+			return fmt.Errorf("can't load totp_path file: %w", err)
+		}
+	}
+
+	var newACL map[string]*UserPolicy
+	if auth.aclFilename != "" {
+		auth.logger.Info("reloading acl file from %q...", auth.aclFilename)
+		newACL, err = loadACLFile(auth.aclFilename)
+		if err != nil {
+			return fmt.Errorf("can't load acl file: %w", err)
+		}
+	}
 
 	auth.pwMux.Lock()
 	auth.pwFile = newPwFile
-	auth.lastReloaded = now
 	auth.pwMux.Unlock()
-	auth.logger.Info("password file reloaded.")
 
-	return nil
-}
-
-func (auth *BasicAuth) condReload() error {
-	reload := func() bool {
-		pwFileModTime, err := fileModTime(auth.pwFilename)
-		if err != nil {
-			auth.logger.Warning("can't get password file modtime: %v", err)
-			return true
-		}
-		return !pwFileModTime.Before(auth.lastReloaded)
-	}()
-	if reload {
-		return auth.reload()
+	if auth.aclFilename != "" {
+		auth.aclMux.Lock()
+		auth.acl = newACL
+		auth.aclMux.Unlock()
 	}
-	return nil
-}
 
-func (auth *BasicAuth) reloadLoop(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-auth.stopChan:
-			return
-		case <-ticker.C:
-			auth.condReload()
-		}
+	if auth.totpEnabled {
+		auth.totpMux.Lock()
+		auth.totpSecrets = newTOTPSecrets
+		auth.totpMux.Unlock()
 	}
+
+	auth.logger.Info("password file reloaded.")
+
+	return nil
 }
 
 func (auth *BasicAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
 	hdr := req.Header.Get("Proxy-Authorization")
 	if hdr == "" {
+		auth.audit.Emit(newAuditEvent(req, "", AuthResultFailure, "missing proxy-authorization header"))
 		requireBasicAuth(wr, req, auth.hiddenDomain)
 		return "", false
 	}
 	hdr_parts := strings.SplitN(hdr, " ", 2)
 	if len(hdr_parts) != 2 || strings.ToLower(hdr_parts[0]) != "basic" {
+		auth.audit.Emit(newAuditEvent(req, "", AuthResultFailure, "malformed proxy-authorization header"))
 		requireBasicAuth(wr, req, auth.hiddenDomain)
 		return "", false
 	}
@@ -228,26 +340,38 @@ func (auth *BasicAuth) Validate(wr http.ResponseWriter, req *http.Request) (stri
 	token := hdr_parts[1]
 	data, err := base64.StdEncoding.DecodeString(token)
 	if err != nil {
+		auth.audit.Emit(newAuditEvent(req, "", AuthResultFailure, "malformed basic auth token"))
 		requireBasicAuth(wr, req, auth.hiddenDomain)
 		return "", false
 	}
 
 	pair := strings.SplitN(string(data), ":", 2)
 	if len(pair) != 2 {
+		auth.audit.Emit(newAuditEvent(req, "", AuthResultFailure, "malformed basic auth credentials"))
 		requireBasicAuth(wr, req, auth.hiddenDomain)
 		return "", false
 	}
 
 	login := pair[0]
 	password := pair[1]
+	otpCode := req.Header.Get("X-OTP")
+	if auth.totpEnabled && otpCode == "" {
+		password, otpCode = splitPasswordOTP(password)
+	}
 
 	auth.pwMux.RLock()
 	pwFile := auth.pwFile
 	auth.pwMux.RUnlock()
 
 	if pwFile.Match(login, password) {
+		if auth.totpEnabled && !auth.verifyTOTPForLogin(login, otpCode, req) {
+			auth.audit.Emit(newAuditEvent(req, login, AuthResultFailure, "totp verification failed"))
+			requireBasicAuth(wr, req, auth.hiddenDomain)
+			return "", false
+		}
 		if auth.hiddenDomain != "" &&
 			(req.Host == auth.hiddenDomain || req.URL.Host == auth.hiddenDomain) {
+			auth.audit.Emit(newAuditEvent(req, login, AuthResultHiddenTrigger, ""))
 			wr.Header().Set("Content-Length", strconv.Itoa(len([]byte(AUTH_TRIGGERED_MSG))))
 			wr.Header().Set("Pragma", "no-cache")
 			wr.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -257,35 +381,111 @@ func (auth *BasicAuth) Validate(wr http.ResponseWriter, req *http.Request) (stri
 			wr.Write([]byte(AUTH_TRIGGERED_MSG))
 			return "", false
 		} else {
+			if policy, ok := auth.lookupPolicy(login); ok {
+				if policy.Expired() {
+					auth.audit.Emit(newAuditEvent(req, login, AuthResultFailure, "policy expired"))
+					requireBasicAuth(wr, req, auth.hiddenDomain)
+					return "", false
+				}
+				targetHost := requestTargetHost(req)
+				if !policy.HostAllowed(targetHost) {
+					auth.audit.Emit(newAuditEvent(req, login, AuthResultFailure, fmt.Sprintf("host %q denied by acl", targetHost)))
+					http.Error(wr, BAD_REQ_MSG, http.StatusForbidden)
+					return "", false
+				}
+				if !policy.Allow() {
+					auth.audit.Emit(newAuditEvent(req, login, AuthResultFailure, "rate limit exceeded"))
+					http.Error(wr, TOO_MANY_REQ_MSG, http.StatusTooManyRequests)
+					return "", false
+				}
+				if !policy.TryAcquireConn() {
+					auth.audit.Emit(newAuditEvent(req, login, AuthResultFailure, "max_conns exceeded"))
+					http.Error(wr, TOO_MANY_REQ_MSG, http.StatusTooManyRequests)
+					return "", false
+				}
+				if policy.Limited() {
+					go func() {
+						<-req.Context().Done()
+						policy.ReleaseConn()
+					}()
+				}
+			}
+			auth.audit.Emit(newAuditEvent(req, login, AuthResultSuccess, ""))
 			return login, true
 		}
 	}
+	auth.audit.Emit(newAuditEvent(req, login, AuthResultFailure, "bad credentials"))
 	requireBasicAuth(wr, req, auth.hiddenDomain)
 	return "", false
 }
 
+// verifyTOTPForLogin checks the TOTP code for login, skipping the check if
+// this client IP + login already passed within totp_grace=.
+func (auth *BasicAuth) verifyTOTPForLogin(login, code string, req *http.Request) bool {
+	graceKey := forwardClientIP(req) + "|" + login
+	if auth.totpCache.check(graceKey) {
+		return true
+	}
+
+	auth.totpMux.RLock()
+	secret, ok := auth.totpSecrets[login]
+	auth.totpMux.RUnlock()
+	if !ok || !verifyTOTP(secret, code) {
+		return false
+	}
+
+	auth.totpCache.remember(graceKey, auth.totpGrace)
+	return true
+}
+
+// requestTargetHost returns the proxy's destination host for req, i.e. the
+// host an ACL's allow_hosts/deny_hosts should be matched against: the
+// request-URI's host (for CONNECT, the tunnel target), falling back to the
+// Host header when the request-URI carries no host.
+func requestTargetHost(req *http.Request) string {
+	if req.URL.Host != "" {
+		return req.URL.Host
+	}
+	return req.Host
+}
+
+func (auth *BasicAuth) lookupPolicy(login string) (*UserPolicy, bool) {
+	auth.aclMux.RLock()
+	defer auth.aclMux.RUnlock()
+	policy, ok := auth.acl[login]
+	return policy, ok
+}
+
 func (auth *BasicAuth) Stop() {
-	auth.stopOnce.Do(func() {
-		close(auth.stopChan)
-	})
+	if auth.reloader != nil {
+		auth.reloader.Stop()
+	}
 }
 
-type NoAuth struct{}
+type NoAuth struct {
+	audit AuditSink
+}
 
-func (_ NoAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
+func (auth NoAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
+	auth.audit.Emit(newAuditEvent(req, "", AuthResultSuccess, "no auth configured"))
 	return "", true
 }
 
 func (_ NoAuth) Stop() {}
 
-type CertAuth struct{}
+type CertAuth struct {
+	audit AuditSink
+}
 
-func (_ CertAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
+func (auth CertAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
 	if req.TLS == nil || len(req.TLS.VerifiedChains) < 1 || len(req.TLS.VerifiedChains[0]) < 1 {
+		auth.audit.Emit(newAuditEvent(req, "", AuthResultCertRejected, "no verified client certificate"))
 		http.Error(wr, BAD_REQ_MSG, http.StatusBadRequest)
 		return "", false
 	} else {
-		return req.TLS.VerifiedChains[0][0].Subject.String(), true
+		login := req.TLS.VerifiedChains[0][0].Subject.String()
+		auth.audit.Emit(newAuditEvent(req, login, AuthResultSuccess, ""))
+		return login, true
 	}
 }
 
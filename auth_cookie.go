@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tg123/go-htpasswd"
+)
+
+const COOKIE_NAME = "dumbproxy_auth"
+
+const LOGIN_FORM_MSG = `<!DOCTYPE html>
+<html>
+<head>
+<title>dumbproxy: sign in</title>
+<style>
+    body {
+        width: 35em;
+        margin: 0 auto;
+        font-family: Tahoma, Verdana, Arial, sans-serif;
+    }
+</style>
+</head>
+<body>
+<h1>Sign in</h1>
+<form method="POST" action="%s">
+<p><label>Username: <input type="text" name="username" autofocus></label></p>
+<p><label>Password: <input type="password" name="password"></label></p>
+<p><input type="submit" value="Sign in"></p>
+</form>
+</body>
+</html>`
+
+const LOGIN_FAILED_MSG = "Login failed\n"
+const LOGIN_SUCCESS_MSG = "Login successful. You may close this page and retry your request.\n"
+
+// CookieAuth authenticates browser clients via a short-lived, HMAC-signed
+// session cookie instead of re-checking Basic credentials on every request.
+// When the cookie is missing or invalid, it falls back to serving (and
+// processing) an HTML login form at hiddenDomain, reusing the same htpasswd
+// plumbing as BasicAuth.
+type CookieAuth struct {
+	pwFilename   string
+	pwFile       *htpasswd.File
+	pwMux        sync.RWMutex
+	logger       *CondLogger
+	audit        AuditSink
+	hmacKey      []byte
+	ttl          time.Duration
+	hiddenDomain string
+	reloader     *reloader
+}
+
+func NewCookieAuth(param_url *url.URL, logger *CondLogger, audit AuditSink) (*CookieAuth, error) {
+	values, err := url.ParseQuery(param_url.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := values.Get("path")
+	if filename == "" {
+		return nil, errors.New("\"path\" parameter is missing from auth config URI")
+	}
+
+	hiddenDomain := strings.ToLower(values.Get("hidden_domain"))
+	if hiddenDomain == "" {
+		return nil, errors.New("\"hidden_domain\" parameter is missing from auth config URI")
+	}
+
+	key, err := loadHMACKey(values)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := time.ParseDuration(values.Get("ttl"))
+	if err != nil || ttl <= 0 {
+		ttl = 12 * time.Hour
+	}
+
+	auth := &CookieAuth{
+		hiddenDomain: hiddenDomain,
+		pwFilename:   filename,
+		hmacKey:      key,
+		ttl:          ttl,
+		logger:       logger,
+		audit:        audit,
+	}
+
+	auth.reloader = newReloader(logger, auth.reloadPasswordData, auth.watchedFiles)
+	if err := auth.reloader.reload(); err != nil {
+		return nil, fmt.Errorf("unable to load initial password list: %w", err)
+	}
+
+	reloadIntervalOption := values.Get("reload")
+	reloadInterval, err := time.ParseDuration(reloadIntervalOption)
+	if err != nil {
+		reloadInterval = 0
+	}
+	if reloadInterval == 0 {
+		reloadInterval = 15 * time.Second
+	}
+	auth.reloader.startLoop(reloadInterval)
+
+	return auth, nil
+}
+
+func (auth *CookieAuth) watchedFiles() []string {
+	return []string{auth.pwFilename}
+}
+
+func loadHMACKey(values url.Values) ([]byte, error) {
+	secret := values.Get("secret")
+	secretFile := values.Get("secret_file")
+	switch {
+	case secret != "":
+		return []byte(secret), nil
+	case secretFile != "":
+		data, err := os.ReadFile(secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read secret_file: %w", err)
+		}
+		key := []byte(strings.TrimSpace(string(data)))
+		if len(key) == 0 {
+			return nil, errors.New("secret_file is empty")
+		}
+		return key, nil
+	default:
+		return nil, errors.New("either \"secret\" or \"secret_file\" parameter is required in auth config URI")
+	}
+}
+
+func (auth *CookieAuth) reloadPasswordData() error {
+	auth.logger.Info("reloading password file from %q...", auth.pwFilename)
+	newPwFile, err := htpasswd.New(auth.pwFilename, htpasswd.DefaultSystems, func(parseErr error) {
+		auth.logger.Error("failed to parse line in %q: %v", auth.pwFilename, parseErr)
+	})
+	if err != nil {
+		return err
+	}
+
+	auth.pwMux.Lock()
+	auth.pwFile = newPwFile
+	auth.pwMux.Unlock()
+	auth.logger.Info("password file reloaded.")
+
+	return nil
+}
+
+func (auth *CookieAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
+	if login, ok := auth.validateCookie(req); ok {
+		auth.audit.Emit(newAuditEvent(req, login, AuthResultSuccess, "cookie"))
+		return login, true
+	}
+
+	if auth.isHiddenDomain(req) {
+		if req.Method == http.MethodPost {
+			auth.handleLogin(wr, req)
+		} else {
+			auth.audit.Emit(newAuditEvent(req, "", AuthResultHiddenTrigger, "login form served"))
+			auth.serveLoginForm(wr)
+		}
+		return "", false
+	}
+
+	auth.audit.Emit(newAuditEvent(req, "", AuthResultFailure, "no valid auth cookie"))
+	auth.requireLogin(wr)
+	return "", false
+}
+
+func (auth *CookieAuth) validateCookie(req *http.Request) (string, bool) {
+	cookie, err := req.Cookie(COOKIE_NAME)
+	if err != nil {
+		return "", false
+	}
+	login, expiry, ok := verifySignedToken(auth.hmacKey, cookie.Value)
+	if !ok || time.Now().Unix() > expiry {
+		return "", false
+	}
+	return login, true
+}
+
+func (auth *CookieAuth) isHiddenDomain(req *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(req.URL.Host)), []byte(auth.hiddenDomain)) == 1 ||
+		subtle.ConstantTimeCompare([]byte(strings.ToLower(req.Host)), []byte(auth.hiddenDomain)) == 1
+}
+
+func (auth *CookieAuth) serveLoginForm(wr http.ResponseWriter) {
+	body := fmt.Sprintf(LOGIN_FORM_MSG, auth.hiddenDomain)
+	wr.Header().Set("Content-Type", "text/html; charset=utf-8")
+	wr.Header().Set("Content-Length", strconv.Itoa(len([]byte(body))))
+	wr.WriteHeader(http.StatusOK)
+	wr.Write([]byte(body))
+}
+
+func (auth *CookieAuth) handleLogin(wr http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(wr, BAD_REQ_MSG, http.StatusBadRequest)
+		return
+	}
+	login := req.PostForm.Get("username")
+	password := req.PostForm.Get("password")
+
+	auth.pwMux.RLock()
+	pwFile := auth.pwFile
+	auth.pwMux.RUnlock()
+
+	if login == "" || !pwFile.Match(login, password) {
+		auth.audit.Emit(newAuditEvent(req, login, AuthResultFailure, "bad login form credentials"))
+		wr.Header().Set("Content-Length", strconv.Itoa(len([]byte(LOGIN_FAILED_MSG))))
+		wr.WriteHeader(http.StatusUnauthorized)
+		wr.Write([]byte(LOGIN_FAILED_MSG))
+		return
+	}
+	auth.audit.Emit(newAuditEvent(req, login, AuthResultSuccess, "login form"))
+
+	expiry := time.Now().Add(auth.ttl).Unix()
+	token := signToken(auth.hmacKey, login, expiry)
+	http.SetCookie(wr, &http.Cookie{
+		Name:     COOKIE_NAME,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Unix(expiry, 0),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	wr.Header().Set("Content-Length", strconv.Itoa(len([]byte(LOGIN_SUCCESS_MSG))))
+	wr.Header().Set("Pragma", "no-cache")
+	wr.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	wr.Header().Set("Expires", EPOCH_EXPIRE)
+	wr.WriteHeader(http.StatusOK)
+	wr.Write([]byte(LOGIN_SUCCESS_MSG))
+}
+
+func (auth *CookieAuth) requireLogin(wr http.ResponseWriter) {
+	msg := fmt.Sprintf("Sign in required. Please visit %q to authenticate.\n", auth.hiddenDomain)
+	wr.Header().Set("Content-Length", strconv.Itoa(len([]byte(msg))))
+	wr.WriteHeader(407)
+	wr.Write([]byte(msg))
+}
+
+func (auth *CookieAuth) Stop() {
+	auth.reloader.Stop()
+}
+
+// signToken produces base64(username \x00 expiry || HMAC-SHA256(key, username \x00 expiry)),
+// with the 32-byte HMAC appended directly after the payload.
+func signToken(key []byte, login string, expiry int64) string {
+	payload := []byte(fmt.Sprintf("%s\x00%d", login, expiry))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return base64.URLEncoding.EncodeToString(append(payload, mac.Sum(nil)...))
+}
+
+// verifySignedToken validates the signature produced by signToken and
+// returns the embedded login and expiry on success.
+func verifySignedToken(key []byte, token string) (string, int64, bool) {
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil || len(raw) <= sha256.Size {
+		return "", 0, false
+	}
+	payload := raw[:len(raw)-sha256.Size]
+	sig := raw[len(raw)-sha256.Size:]
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if subtle.ConstantTimeCompare(sig, mac.Sum(nil)) != 1 {
+		return "", 0, false
+	}
+
+	parts := strings.SplitN(string(payload), "\x00", 2)
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], expiry, true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestSignTokenRoundTrip(t *testing.T) {
+	key := []byte("test-hmac-key")
+	expiry := time.Now().Add(time.Hour).Unix()
+
+	token := signToken(key, "alice", expiry)
+
+	login, gotExpiry, ok := verifySignedToken(key, token)
+	if !ok {
+		t.Fatal("verifySignedToken() = false for a freshly signed token")
+	}
+	if login != "alice" {
+		t.Errorf("login = %q, want alice", login)
+	}
+	if gotExpiry != expiry {
+		t.Errorf("expiry = %d, want %d", gotExpiry, expiry)
+	}
+}
+
+func TestVerifySignedTokenRejectsTamperedPayload(t *testing.T) {
+	key := []byte("test-hmac-key")
+	token := signToken(key, "alice", time.Now().Add(time.Hour).Unix())
+
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("can't decode signed token: %v", err)
+	}
+	raw[0] ^= 0xff
+	tampered := base64.URLEncoding.EncodeToString(raw)
+
+	if _, _, ok := verifySignedToken(key, tampered); ok {
+		t.Error("verifySignedToken() = true for a tampered token, want false")
+	}
+}
+
+func TestVerifySignedTokenRejectsWrongKey(t *testing.T) {
+	token := signToken([]byte("key-one"), "alice", time.Now().Add(time.Hour).Unix())
+	if _, _, ok := verifySignedToken([]byte("key-two"), token); ok {
+		t.Error("verifySignedToken() = true when verifying with the wrong key, want false")
+	}
+}
+
+func TestVerifySignedTokenRejectsGarbage(t *testing.T) {
+	if _, _, ok := verifySignedToken([]byte("key"), "not-base64!!"); ok {
+		t.Error("verifySignedToken() = true for non-base64 input, want false")
+	}
+	if _, _, ok := verifySignedToken([]byte("key"), ""); ok {
+		t.Error("verifySignedToken() = true for empty input, want false")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_FORWARD_AUTH_HEADER = "X-Auth-User"
+const DEFAULT_FORWARD_AUTH_TIMEOUT = 5 * time.Second
+const FORWARD_AUTH_CACHE_CAPACITY = 4096
+
+// ForwardAuth delegates authentication decisions to an external HTTP
+// endpoint, the pattern used by Traefik/Caddy forward-auth middleware. A
+// 2xx upstream response authorizes the request (the login is read from
+// userHeader); any other status is relayed back to the client verbatim so
+// the upstream can redirect to its own login UI.
+type ForwardAuth struct {
+	url        string
+	userHeader string
+	client     *http.Client
+	cache      *forwardCache
+	logger     *CondLogger
+	audit      AuditSink
+}
+
+func NewForwardAuth(param_url *url.URL, logger *CondLogger, audit AuditSink) (*ForwardAuth, error) {
+	values, err := url.ParseQuery(param_url.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamURL := values.Get("url")
+	if upstreamURL == "" {
+		return nil, errors.New("\"url\" parameter is missing from auth config URI")
+	}
+
+	userHeader := values.Get("user_header")
+	if userHeader == "" {
+		userHeader = DEFAULT_FORWARD_AUTH_HEADER
+	}
+
+	timeout, err := time.ParseDuration(values.Get("timeout"))
+	if err != nil || timeout <= 0 {
+		timeout = DEFAULT_FORWARD_AUTH_TIMEOUT
+	}
+
+	tlsConfig, err := buildForwardTLSConfig(values.Get("ca"), values.Get("insecure") == "true")
+	if err != nil {
+		return nil, err
+	}
+
+	var cache *forwardCache
+	if cacheTTL, err := time.ParseDuration(values.Get("cache_ttl")); err == nil && cacheTTL > 0 {
+		cache = newForwardCache(FORWARD_AUTH_CACHE_CAPACITY, cacheTTL)
+	}
+
+	return &ForwardAuth{
+		url:        upstreamURL,
+		userHeader: userHeader,
+		logger:     logger,
+		audit:      audit,
+		cache:      cache,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+func buildForwardTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pemData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, errors.New("no certificates found in ca file")
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
+
+func (auth *ForwardAuth) Validate(wr http.ResponseWriter, req *http.Request) (string, bool) {
+	cacheKey := auth.cacheKey(req)
+	if auth.cache != nil && cacheKey != "" {
+		if login, ok := auth.cache.get(cacheKey); ok {
+			auth.audit.Emit(newAuditEvent(req, login, AuthResultSuccess, "cache hit"))
+			return login, true
+		}
+	}
+
+	upstreamReq, err := http.NewRequest(http.MethodGet, auth.url, nil)
+	if err != nil {
+		auth.logger.Error("forward auth: can't build upstream request: %v", err)
+		http.Error(wr, BAD_REQ_MSG, http.StatusInternalServerError)
+		return "", false
+	}
+	copyForwardHeaders(upstreamReq, req)
+
+	resp, err := auth.client.Do(upstreamReq)
+	if err != nil {
+		auth.logger.Error("forward auth: upstream request failed: %v", err)
+		auth.audit.Emit(newAuditEvent(req, "", AuthResultFailure, fmt.Sprintf("upstream request failed: %v", err)))
+		http.Error(wr, BAD_REQ_MSG, http.StatusBadGateway)
+		return "", false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		login := resp.Header.Get(auth.userHeader)
+		if auth.cache != nil && cacheKey != "" {
+			auth.cache.put(cacheKey, login)
+		}
+		auth.audit.Emit(newAuditEvent(req, login, AuthResultSuccess, ""))
+		return login, true
+	}
+
+	auth.audit.Emit(newAuditEvent(req, "", AuthResultFailure, fmt.Sprintf("upstream returned status %d", resp.StatusCode)))
+	proxyForwardResponse(wr, resp)
+	return "", false
+}
+
+func (auth *ForwardAuth) Stop() {}
+
+// cacheKey identifies the client for the forward-auth cache. It always
+// binds to the client IP in addition to any credentials presented: for the
+// mTLS/IP-based SSO case the upstream auth decision is keyed off the
+// connection itself, and without the IP here every such request (having no
+// Proxy-Authorization or Cookie at all) would collide onto one cache entry,
+// letting one authorized client's cache hit authorize everyone else's.
+func (auth *ForwardAuth) cacheKey(req *http.Request) string {
+	if auth.cache == nil {
+		return ""
+	}
+	h := sha256.New()
+	io.WriteString(h, forwardClientIP(req))
+	io.WriteString(h, "\x00")
+	io.WriteString(h, req.Header.Get("Proxy-Authorization"))
+	io.WriteString(h, "\x00")
+	io.WriteString(h, req.Header.Get("Cookie"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func copyForwardHeaders(upstreamReq, req *http.Request) {
+	if v := req.Header.Get("Proxy-Authorization"); v != "" {
+		upstreamReq.Header.Set("Proxy-Authorization", v)
+	}
+	for _, cookie := range req.Cookies() {
+		upstreamReq.AddCookie(cookie)
+	}
+	for name, values := range req.Header {
+		if strings.HasPrefix(name, "X-Forwarded-") {
+			upstreamReq.Header[name] = values
+		}
+	}
+	if clientIP := forwardClientIP(req); clientIP != "" {
+		upstreamReq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	upstreamReq.Header.Set("X-Forwarded-Host", req.Host)
+	upstreamReq.Header.Set("X-Forwarded-Proto", forwardScheme(req))
+}
+
+func forwardClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func forwardScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func proxyForwardResponse(wr http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Header {
+		for _, v := range values {
+			wr.Header().Add(name, v)
+		}
+	}
+	// resp.ContentLength is -1 for chunked/unknown-length responses; setting
+	// Content-Length to "-1" would send an invalid header, so just omit it
+	// and let the client fall back to reading until EOF/chunk-terminator.
+	if resp.ContentLength >= 0 {
+		wr.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	wr.WriteHeader(resp.StatusCode)
+	io.Copy(wr, resp.Body)
+}
+
+// forwardCache is a small in-memory LRU keyed by a hash of the forwarded
+// credentials, so repeated requests don't hammer the upstream auth server.
+type forwardCache struct {
+	mux      sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type forwardCacheItem struct {
+	key     string
+	login   string
+	expires time.Time
+}
+
+func newForwardCache(capacity int, ttl time.Duration) *forwardCache {
+	return &forwardCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *forwardCache) get(key string) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	item := el.Value.(*forwardCacheItem)
+	if time.Now().After(item.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return item.login, true
+}
+
+func (c *forwardCache) put(key, login string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if el, ok := c.entries[key]; ok {
+		item := el.Value.(*forwardCacheItem)
+		item.login = login
+		item.expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	el := c.order.PushFront(&forwardCacheItem{
+		key:     key,
+		login:   login,
+		expires: time.Now().Add(c.ttl),
+	})
+	c.entries[key] = el
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*forwardCacheItem).key)
+	}
+}
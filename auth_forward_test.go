@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestForwardAuthCacheKeyBindsToClientIP(t *testing.T) {
+	auth := &ForwardAuth{cache: newForwardCache(16, time.Minute)}
+
+	reqA := &http.Request{Header: http.Header{}, RemoteAddr: "10.0.0.1:1234"}
+	reqB := &http.Request{Header: http.Header{}, RemoteAddr: "10.0.0.2:5678"}
+
+	keyA := auth.cacheKey(reqA)
+	keyB := auth.cacheKey(reqB)
+
+	if keyA == "" || keyB == "" {
+		t.Fatal("cacheKey should not be empty when caching is enabled")
+	}
+	if keyA == keyB {
+		t.Error("requests from different client IPs with no credentials must not share a cache key")
+	}
+}
+
+func TestForwardAuthCacheKeyNilWithoutCache(t *testing.T) {
+	auth := &ForwardAuth{}
+	req := &http.Request{Header: http.Header{}, RemoteAddr: "10.0.0.1:1234"}
+	if got := auth.cacheKey(req); got != "" {
+		t.Errorf("cacheKey() = %q, want empty when no cache is configured", got)
+	}
+}
+
+func TestForwardCacheGetPutAndExpiry(t *testing.T) {
+	c := newForwardCache(2, 10*time.Millisecond)
+	c.put("a", "alice")
+
+	if login, ok := c.get("a"); !ok || login != "alice" {
+		t.Fatalf("get(a) = (%q, %v), want (alice, true)", login, ok)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Error("expected expired entry to be evicted")
+	}
+}
+
+func TestForwardCacheEvictsOldest(t *testing.T) {
+	c := newForwardCache(2, time.Minute)
+	c.put("a", "alice")
+	c.put("b", "bob")
+	c.put("c", "carol")
+
+	if _, ok := c.get("a"); ok {
+		t.Error("expected oldest entry to be evicted once capacity is exceeded")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Error("expected b to still be cached")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Error("expected c to still be cached")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPasswordFileArgon2id(t *testing.T) {
+	line, err := formatArgon2idLine("alice", "correct horse")
+	if err != nil {
+		t.Fatalf("formatArgon2idLine: %v", err)
+	}
+
+	pwFile, err := loadHashPasswordFileFromReader(strings.NewReader(line), "argon2id", nil)
+	if err != nil {
+		t.Fatalf("loadHashPasswordFileFromReader: %v", err)
+	}
+
+	if !pwFile.Match("alice", "correct horse") {
+		t.Error("Match() = false for correct password, want true")
+	}
+	if pwFile.Match("alice", "wrong password") {
+		t.Error("Match() = true for wrong password, want false")
+	}
+	if pwFile.Match("bob", "correct horse") {
+		t.Error("Match() = true for unknown login, want false")
+	}
+}
+
+func TestHashPasswordFileScrypt(t *testing.T) {
+	line, err := formatScryptLine("alice", "correct horse")
+	if err != nil {
+		t.Fatalf("formatScryptLine: %v", err)
+	}
+
+	pwFile, err := loadHashPasswordFileFromReader(strings.NewReader(line), "scrypt", nil)
+	if err != nil {
+		t.Fatalf("loadHashPasswordFileFromReader: %v", err)
+	}
+
+	if !pwFile.Match("alice", "correct horse") {
+		t.Error("Match() = false for correct password, want true")
+	}
+	if pwFile.Match("alice", "wrong password") {
+		t.Error("Match() = true for wrong password, want false")
+	}
+}
+
+func TestHashPasswordFileDummyCostTracksFileParams(t *testing.T) {
+	// A hand-crafted line with cost parameters far lower than this repo's
+	// own "passwd" subcommand defaults: the dummy cost for unknown users
+	// must track *this*, not the hardcoded defaults, or the timing oracle
+	// the fix is meant to close reopens for externally-generated lines.
+	line := "alice:$argon2id$v=19$m=8,t=1,p=1$AAAAAAAAAAAAAAAAAAAAAA$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	// salt/hash above are base64.RawStdEncoding of 16 and 32 zero bytes
+	// respectively; their content is irrelevant to this test.
+
+	pwFile, err := loadHashPasswordFileFromReader(strings.NewReader(line), "argon2id", nil)
+	if err != nil {
+		t.Fatalf("loadHashPasswordFileFromReader: %v", err)
+	}
+
+	cost, ok := pwFile.dummyCost.(argon2idCost)
+	if !ok {
+		t.Fatalf("dummyCost = %T, want argon2idCost", pwFile.dummyCost)
+	}
+	if cost.memory != 8 || cost.iterations != 1 || cost.parallelism != 1 {
+		t.Errorf("dummyCost = %+v, want memory=8 iterations=1 parallelism=1 (from the file, not built-in defaults)", cost)
+	}
+
+	// An unknown login must still just return false; the dummy KDF call
+	// shouldn't itself be observable as a behavioral difference.
+	if pwFile.Match("bob", "whatever") {
+		t.Error("Match() = true for unknown login, want false")
+	}
+}
+
+func TestHashPasswordFileSkipsMalformedLines(t *testing.T) {
+	good, err := formatArgon2idLine("alice", "secret")
+	if err != nil {
+		t.Fatalf("formatArgon2idLine: %v", err)
+	}
+	input := "not-a-valid-line\n" + good + "\n# comment\n\n"
+
+	var parseErrs []error
+	pwFile, err := loadHashPasswordFileFromReader(strings.NewReader(input), "argon2id", func(e error) {
+		parseErrs = append(parseErrs, e)
+	})
+	if err != nil {
+		t.Fatalf("loadHashPasswordFileFromReader: %v", err)
+	}
+	if len(parseErrs) != 1 {
+		t.Errorf("got %d parse errors, want 1", len(parseErrs))
+	}
+	if !pwFile.Match("alice", "secret") {
+		t.Error("Match() = false for valid line after a malformed one, want true")
+	}
+}
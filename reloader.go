@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// reloader runs the periodic conditional-reload loop shared by the
+// file-backed auth providers (BasicAuth, CookieAuth): it re-runs reloadFunc
+// whenever any file named by watchFiles has changed since the last
+// successful reload. Callers own what "reload" actually means (parsing a
+// password file, an ACL, a TOTP sidecar, ...); reloader only owns the
+// scheduling.
+type reloader struct {
+	logger       *CondLogger
+	reloadFunc   func() error
+	watchFiles   func() []string
+	lastReloaded time.Time
+	stopOnce     sync.Once
+	stopChan     chan struct{}
+}
+
+func newReloader(logger *CondLogger, reloadFunc func() error, watchFiles func() []string) *reloader {
+	return &reloader{
+		logger:     logger,
+		reloadFunc: reloadFunc,
+		watchFiles: watchFiles,
+		stopChan:   make(chan struct{}),
+	}
+}
+
+func (r *reloader) reload() error {
+	if err := r.reloadFunc(); err != nil {
+		return err
+	}
+	r.lastReloaded = time.Now()
+	return nil
+}
+
+func (r *reloader) condReload() error {
+	for _, filename := range r.watchFiles() {
+		modTime, err := fileModTime(filename)
+		if err != nil {
+			r.logger.Warning("can't get modtime for %q: %v", filename, err)
+			return r.reload()
+		}
+		if !modTime.Before(r.lastReloaded) {
+			return r.reload()
+		}
+	}
+	return nil
+}
+
+// startLoop spawns the background reload ticker. A non-positive interval is
+// a no-op. The auth providers replace an unset or zero reload= with a 15s
+// default before calling this, so only a negative reload= disables polling.
+func (r *reloader) startLoop(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go r.loop(interval)
+}
+
+func (r *reloader) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopChan:
+			return
+		case <-ticker.C:
+			r.condReload()
+		}
+	}
+}
+
+func (r *reloader) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopChan)
+	})
+}
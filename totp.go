@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TOTP_STEP = 30 * time.Second
+const TOTP_DIGITS = 6
+const TOTP_WINDOW = 1 // allow +-1 step of clock skew
+const DEFAULT_TOTP_GRACE = 5 * time.Minute
+
+// hotp implements RFC 4226 HOTP: an HMAC-SHA1-based one-time code over a
+// monotonic counter.
+func hotp(secret []byte, counter uint64, digits int) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := (uint32(sum[offset]&0x7f) << 24) |
+		(uint32(sum[offset+1]) << 16) |
+		(uint32(sum[offset+2]) << 8) |
+		uint32(sum[offset+3])
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// totpAt implements RFC 6238 TOTP: HOTP keyed off the current 30s step.
+func totpAt(secret []byte, t time.Time) string {
+	counter := uint64(t.Unix()) / uint64(TOTP_STEP.Seconds())
+	return hotp(secret, counter, TOTP_DIGITS)
+}
+
+// verifyTOTP checks code against a base32-encoded secret within
+// +-TOTP_WINDOW steps of now, comparing each candidate in constant time.
+func verifyTOTP(secretBase32, code string) bool {
+	if code == "" {
+		return false
+	}
+	secret, err := decodeTOTPSecret(secretBase32)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	ok := false
+	for w := -TOTP_WINDOW; w <= TOTP_WINDOW; w++ {
+		candidate := totpAt(secret, now.Add(time.Duration(w)*TOTP_STEP))
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(code)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimSpace(secret))
+	secret = strings.TrimRight(secret, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// splitPasswordOTP splits a "password:123456" basic-auth password into its
+// password and OTP code parts, used when no X-OTP header is present.
+func splitPasswordOTP(password string) (string, string) {
+	idx := strings.LastIndexByte(password, ':')
+	if idx < 0 {
+		return password, ""
+	}
+	return password[:idx], password[idx+1:]
+}
+
+// loadInlineTOTPSecrets reads a password file and splits off an optional
+// third colon-separated field ("user:hash:secret") into a username->secret
+// map, returning the file content with that field stripped so the
+// underlying htpasswd/hash loader only ever sees "user:hash" lines.
+func loadInlineTOTPSecrets(filename string) ([]byte, map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	secrets := make(map[string]string)
+	var stripped bytes.Buffer
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			stripped.WriteString(line)
+			stripped.WriteByte('\n')
+			continue
+		}
+		parts := strings.SplitN(trimmed, ":", 3)
+		if len(parts) == 3 {
+			secrets[parts[0]] = parts[2]
+			stripped.WriteString(parts[0])
+			stripped.WriteByte(':')
+			stripped.WriteString(parts[1])
+		} else {
+			stripped.WriteString(line)
+		}
+		stripped.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return stripped.Bytes(), secrets, nil
+}
+
+// loadTOTPSidecar parses a "username:secret" sidecar file referenced by
+// totp_path=.
+func loadTOTPSidecar(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	secrets := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx < 0 {
+			continue
+		}
+		secrets[line[:idx]] = line[idx+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// otpauthURI formats a provisioning URI suitable for QR-code enrollment in
+// authenticator apps.
+func otpauthURI(issuer, account, secretBase32 string) string {
+	v := url.Values{}
+	v.Set("secret", secretBase32)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(TOTP_DIGITS))
+	v.Set("period", strconv.Itoa(int(TOTP_STEP.Seconds())))
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, account))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, v.Encode())
+}
+
+// totpGraceCache remembers, per "client IP|username" key, that TOTP was
+// already satisfied recently, so browsers aren't re-prompted on every
+// CONNECT within totp_grace=.
+type totpGraceCache struct {
+	mux      sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type totpGraceItem struct {
+	key     string
+	expires time.Time
+}
+
+func newTOTPGraceCache(capacity int) *totpGraceCache {
+	return &totpGraceCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *totpGraceCache) check(key string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	item := el.Value.(*totpGraceItem)
+	if time.Now().After(item.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return false
+	}
+	c.order.MoveToFront(el)
+	return true
+}
+
+func (c *totpGraceCache) remember(key string, ttl time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*totpGraceItem).expires = time.Now().Add(ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	el := c.order.PushFront(&totpGraceItem{key: key, expires: time.Now().Add(ttl)})
+	c.entries[key] = el
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*totpGraceItem).key)
+	}
+}
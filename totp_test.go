@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// RFC 4226 Appendix D test vector: secret "12345678901234567890" (ASCII),
+// counters 0..9.
+func TestHOTP_RFC4226Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+	for counter, expected := range want {
+		if got := hotp(secret, uint64(counter), 6); got != expected {
+			t.Errorf("hotp(counter=%d) = %q, want %q", counter, got, expected)
+		}
+	}
+}
+
+// RFC 6238 Appendix B SHA1 test vectors, same secret as above, 8 digits.
+func TestTOTP_RFC6238Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	cases := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+	}
+	for _, c := range cases {
+		got := hotp(secret, uint64(c.unix)/30, 8)
+		if got != c.want {
+			t.Errorf("totp at %d = %q, want %q", c.unix, got, c.want)
+		}
+	}
+}
+
+func TestVerifyTOTPAcceptsCurrentCode(t *testing.T) {
+	secretBytes := []byte("12345678901234567890")
+	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secretBytes)
+
+	code := totpAt(secretBytes, time.Now())
+	if !verifyTOTP(secretBase32, code) {
+		t.Error("verifyTOTP() = false for the current code, want true")
+	}
+}
+
+func TestVerifyTOTPRejectsWrongCode(t *testing.T) {
+	secretBytes := []byte("12345678901234567890")
+	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secretBytes)
+
+	if verifyTOTP(secretBase32, "000000") {
+		t.Error("verifyTOTP() = true for an almost-certainly-wrong code, want false")
+	}
+	if verifyTOTP(secretBase32, "") {
+		t.Error("verifyTOTP() = true for an empty code, want false")
+	}
+}
+
+func TestSplitPasswordOTP(t *testing.T) {
+	cases := []struct {
+		in, wantPw, wantOTP string
+	}{
+		{"hunter2:123456", "hunter2", "123456"},
+		{"hunter2", "hunter2", ""},
+		{"pass:with:colons:654321", "pass:with:colons", "654321"},
+	}
+	for _, c := range cases {
+		pw, otp := splitPasswordOTP(c.in)
+		if pw != c.wantPw || otp != c.wantOTP {
+			t.Errorf("splitPasswordOTP(%q) = (%q, %q), want (%q, %q)", c.in, pw, otp, c.wantPw, c.wantOTP)
+		}
+	}
+}
+
+func TestTOTPGraceCache(t *testing.T) {
+	c := newTOTPGraceCache(2)
+	if c.check("a") {
+		t.Fatal("check() = true before remember(), want false")
+	}
+
+	c.remember("a", 10*time.Millisecond)
+	if !c.check("a") {
+		t.Fatal("check() = false right after remember(), want true")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if c.check("a") {
+		t.Error("check() = true after grace period elapsed, want false")
+	}
+}
+
+func TestTOTPGraceCacheEvictsOldest(t *testing.T) {
+	c := newTOTPGraceCache(2)
+	c.remember("a", time.Minute)
+	c.remember("b", time.Minute)
+	c.remember("c", time.Minute)
+
+	if c.check("a") {
+		t.Error("expected oldest entry to be evicted once capacity is exceeded")
+	}
+	if !c.check("b") || !c.check("c") {
+		t.Error("expected b and c to still be remembered")
+	}
+}